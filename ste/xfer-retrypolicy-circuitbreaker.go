@@ -0,0 +1,83 @@
+package ste
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// minCircuitBreakerSamples is the minimum number of tries a host must have seen within the current window before
+// circuitBreaker considers tripping it; this keeps a single unlucky failure from opening the circuit.
+const minCircuitBreakerSamples = 5
+
+// CircuitOpenError is returned (as the try's err) when the circuit breaker for a host has tripped and is refusing
+// further tries against it until its cool-down period elapses.
+type CircuitOpenError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open for host %s; cooling down for %v", e.Host, e.RetryAfter)
+}
+
+// circuitBreaker tracks a rolling error rate per host and, once it exceeds threshold within window, refuses
+// further tries against that host for cooldown. It's shared across all tries for a given XferRetryOptions (and,
+// for the common case of a single pipeline, across all the jobs that pipeline ever dials), so that a degraded
+// endpoint gets shunned instead of continuing to be hammered by every new transfer.
+type circuitBreaker struct {
+	threshold float64
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostCircuitStats
+}
+
+type hostCircuitStats struct {
+	windowStart time.Time
+	total       int
+	failed      int
+	openUntil   time.Time
+}
+
+func newCircuitBreaker(threshold float64, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, window: window, cooldown: cooldown, hosts: make(map[string]*hostCircuitStats)}
+}
+
+// allow returns a *CircuitOpenError if host's circuit is currently open, or nil if the try may proceed.
+func (b *circuitBreaker) allow(host string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.hosts[host]
+	if s == nil {
+		return nil
+	}
+	if remaining := s.openUntil.Sub(time.Now()); remaining > 0 {
+		return &CircuitOpenError{Host: host, RetryAfter: remaining}
+	}
+	return nil
+}
+
+// record updates host's rolling error-rate window with the outcome of one try, tripping the circuit if the
+// failure rate now exceeds threshold.
+func (b *circuitBreaker) record(host string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	s := b.hosts[host]
+	if s == nil {
+		s = &hostCircuitStats{windowStart: now}
+		b.hosts[host] = s
+	}
+	if now.Sub(s.windowStart) > b.window {
+		s.windowStart, s.total, s.failed = now, 0, 0
+	}
+	s.total++
+	if failed {
+		s.failed++
+	}
+	if s.total >= minCircuitBreakerSamples && float64(s.failed)/float64(s.total) > b.threshold {
+		s.openUntil = now.Add(b.cooldown)
+	}
+}
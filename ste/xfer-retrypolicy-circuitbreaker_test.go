@@ -0,0 +1,75 @@
+package ste
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_OpensAfterThresholdExceeded(t *testing.T) {
+	b := newCircuitBreaker(0.5, time.Minute, time.Hour)
+
+	if err := b.allow("host"); err != nil {
+		t.Fatalf("allow before any samples: got %v, want nil", err)
+	}
+
+	// minCircuitBreakerSamples-1 failures shouldn't trip it yet, even at a 100% failure rate.
+	for i := 0; i < minCircuitBreakerSamples-1; i++ {
+		b.record("host", true)
+	}
+	if err := b.allow("host"); err != nil {
+		t.Fatalf("allow below minCircuitBreakerSamples: got %v, want nil", err)
+	}
+
+	// One more failure reaches minCircuitBreakerSamples at a 100% failure rate, which exceeds threshold.
+	b.record("host", true)
+	err := b.allow("host")
+	if err == nil {
+		t.Fatalf("allow after threshold exceeded: got nil, want *CircuitOpenError")
+	}
+	var cbErr *CircuitOpenError
+	if !errors.As(err, &cbErr) {
+		t.Fatalf("got err of type %T, want *CircuitOpenError", err)
+	}
+	if cbErr.Host != "host" {
+		t.Fatalf("got Host=%q, want %q", cbErr.Host, "host")
+	}
+}
+
+func TestCircuitBreaker_ClosesAfterCooldown(t *testing.T) {
+	b := newCircuitBreaker(0.5, time.Minute, 20*time.Millisecond)
+	for i := 0; i < minCircuitBreakerSamples; i++ {
+		b.record("host", true)
+	}
+	if err := b.allow("host"); err == nil {
+		t.Fatalf("allow right after tripping: got nil, want *CircuitOpenError")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if err := b.allow("host"); err != nil {
+		t.Fatalf("allow after cooldown elapsed: got %v, want nil", err)
+	}
+}
+
+func TestCircuitBreaker_StaysClosedBelowThreshold(t *testing.T) {
+	b := newCircuitBreaker(0.5, time.Minute, time.Hour)
+	for i := 0; i < 10; i++ {
+		b.record("host", i%4 == 0) // 30% failure rate (3 of 10), below the 50% threshold
+	}
+	if err := b.allow("host"); err != nil {
+		t.Fatalf("allow below threshold: got %v, want nil", err)
+	}
+}
+
+func TestCircuitBreaker_TracksHostsIndependently(t *testing.T) {
+	b := newCircuitBreaker(0.5, time.Minute, time.Hour)
+	for i := 0; i < minCircuitBreakerSamples; i++ {
+		b.record("bad-host", true)
+	}
+	if err := b.allow("bad-host"); err == nil {
+		t.Fatalf("allow(bad-host): got nil, want *CircuitOpenError")
+	}
+	if err := b.allow("good-host"); err != nil {
+		t.Fatalf("allow(good-host): got %v, want nil", err)
+	}
+}
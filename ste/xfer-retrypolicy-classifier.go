@@ -0,0 +1,69 @@
+package ste
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+)
+
+// RetryAction is the decision a RetryClassifier makes about a completed try.
+type RetryAction int32
+
+const (
+	// RetryActionNoRetry means the try's outcome should be returned to the caller as-is.
+	RetryActionNoRetry RetryAction = iota
+	// RetryActionRetry means the operation should be retried against whichever host (primary or secondary) the
+	// loop would otherwise have picked next.
+	RetryActionRetry
+	// RetryActionRetryOnSecondary means the operation should be retried and, if RetryReadsFromSecondaryHost is
+	// set, later tries alternate between the primary (odd tries) and the secondary (even tries) host. The primary
+	// stays in that rotation.
+	RetryActionRetryOnSecondary
+	// RetryActionFatal means the try's outcome is unrecoverable; retrying (on either host) won't help.
+	RetryActionFatal
+)
+
+// RetryClassifier decides what a retry policy should do after a completed try. NewXferRetryPolicyFactory consults
+// one before sleeping and trying again, so tests can substitute a deterministic classifier instead of relying on
+// real (and racy) network conditions, and callers can layer in domain-specific retry logic without forking the
+// whole policy. The per-host circuit breaker (see circuitBreaker in xfer-retrypolicy-circuitbreaker.go) is not a
+// RetryClassifier; it runs as a separate check in front of whichever classifier is in effect.
+type RetryClassifier interface {
+	// Classify inspects the outcome of a try (resp and/or err, exactly one of which is normally non-nil) and
+	// returns the action the retry loop should take. try is the 1-based attempt number that just completed.
+	Classify(resp pipeline.Response, err error, try int32) RetryAction
+}
+
+// defaultRetryClassifier reproduces the retry policy's original, hard-coded behavior: fatal on a Bad Request
+// response, retry on a throttled response that carries a Retry-After hint, retry on any net.Error, and otherwise
+// stop. It does not know about primary/secondary host selection; that remains the retry loop's job.
+type defaultRetryClassifier struct{}
+
+func (defaultRetryClassifier) Classify(resp pipeline.Response, err error, try int32) RetryAction {
+	switch {
+	case resp != nil && resp.Response().StatusCode == http.StatusBadRequest:
+		// If the request failed with Bad Request, then there is no need to retry since
+		// the request will fail on the future retries as well.
+		return RetryActionFatal
+	case resp != nil && (resp.Response().StatusCode == http.StatusTooManyRequests || resp.Response().StatusCode == http.StatusServiceUnavailable):
+		// The service is throttling us. These arrive as clean HTTP replies (no net.Error), so without this case
+		// they'd otherwise fall through to NoRetry below.
+		if _, ok := parseRetryAfter(resp.Response()); ok {
+			return RetryActionRetry
+		}
+		return RetryActionNoRetry
+	case err != nil:
+		// NOTE: Protocol Responder returns non-nil if REST API returns invalid status code for the invoked operation
+		// retry on all the network errors.
+		// zc_policy_retry perform the retries on Temporary and Timeout Errors only.
+		// some errors like 'connection reset by peer' or 'transport connection broken' does not implement the Temporary interface
+		// but they should be retried. So redefined the retry policy for azcopy to retry for such errors as well.
+		if _, ok := err.(net.Error); ok {
+			return RetryActionRetry
+		}
+		return RetryActionNoRetry
+	default:
+		return RetryActionNoRetry // no error
+	}
+}
@@ -0,0 +1,88 @@
+package ste
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+)
+
+func TestDefaultRetryClassifier_BadRequestIsFatal(t *testing.T) {
+	resp := pipeline.NewHTTPResponse(&http.Response{StatusCode: http.StatusBadRequest, Header: make(http.Header)})
+	if got := (defaultRetryClassifier{}).Classify(resp, nil, 1); got != RetryActionFatal {
+		t.Fatalf("got %v, want RetryActionFatal", got)
+	}
+}
+
+func TestDefaultRetryClassifier_ThrottledWithRetryAfterRetries(t *testing.T) {
+	header := make(http.Header)
+	header.Set("Retry-After", "1")
+	resp := pipeline.NewHTTPResponse(&http.Response{StatusCode: http.StatusServiceUnavailable, Header: header})
+	if got := (defaultRetryClassifier{}).Classify(resp, nil, 1); got != RetryActionRetry {
+		t.Fatalf("got %v, want RetryActionRetry", got)
+	}
+}
+
+func TestDefaultRetryClassifier_ThrottledWithoutRetryAfterDoesNotRetry(t *testing.T) {
+	resp := pipeline.NewHTTPResponse(&http.Response{StatusCode: http.StatusTooManyRequests, Header: make(http.Header)})
+	if got := (defaultRetryClassifier{}).Classify(resp, nil, 1); got != RetryActionNoRetry {
+		t.Fatalf("got %v, want RetryActionNoRetry", got)
+	}
+}
+
+// customClassifier lets a test prove that XferRetryOptions.Classifier actually overrides the built-in
+// decision, realizing the doc comment's promise of a substitutable, deterministic classifier.
+type customClassifier struct {
+	action RetryAction
+	seen   int
+}
+
+func (c *customClassifier) Classify(resp pipeline.Response, err error, try int32) RetryAction {
+	c.seen++
+	return c.action
+}
+
+func TestRetryClassifier_CustomClassifierOverridesDefault(t *testing.T) {
+	custom := &customClassifier{action: RetryActionFatal}
+	// A plain 200 OK would otherwise classify as RetryActionNoRetry under defaultRetryClassifier; the
+	// custom classifier must be consulted instead and win.
+	resp := pipeline.NewHTTPResponse(&http.Response{StatusCode: http.StatusOK, Header: make(http.Header)})
+
+	classifier := resolveClassifier(XferRetryOptions{Classifier: custom})
+	if classifier != custom {
+		t.Fatalf("resolveClassifier did not return the configured Classifier")
+	}
+	if got := classifier.Classify(resp, nil, 1); got != RetryActionFatal {
+		t.Fatalf("got %v, want RetryActionFatal from the custom classifier", got)
+	}
+	if custom.seen != 1 {
+		t.Fatalf("custom classifier was consulted %d times, want 1", custom.seen)
+	}
+}
+
+func TestResolveClassifier_NilFallsBackToDefault(t *testing.T) {
+	classifier := resolveClassifier(XferRetryOptions{})
+	if _, ok := classifier.(defaultRetryClassifier); !ok {
+		t.Fatalf("got classifier of type %T, want defaultRetryClassifier", classifier)
+	}
+}
+
+func TestDefaultRetryClassifier_NetErrorRetries(t *testing.T) {
+	if got := (defaultRetryClassifier{}).Classify(nil, &timeoutError{}, 1); got != RetryActionRetry {
+		t.Fatalf("got %v, want RetryActionRetry", got)
+	}
+}
+
+func TestDefaultRetryClassifier_OtherErrorDoesNotRetry(t *testing.T) {
+	if got := (defaultRetryClassifier{}).Classify(nil, errors.New("boom"), 1); got != RetryActionNoRetry {
+		t.Fatalf("got %v, want RetryActionNoRetry", got)
+	}
+}
+
+// timeoutError is a minimal net.Error for classifier tests.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
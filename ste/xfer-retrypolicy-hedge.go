@@ -0,0 +1,94 @@
+package ste
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+)
+
+// hedgedResult carries the outcome of one leg (primary or hedge) of a doWithHedge race.
+type hedgedResult struct {
+	response pipeline.Response
+	err      error
+}
+
+// doWithHedge issues request against next and, if it has not completed within hedgeAfter, fires a second
+// ("backup") request concurrently against secondaryHost (or the same host, if secondaryHost is ""). Whichever leg
+// completes first wins: its result is returned along with the host it actually came from (so callers like
+// NewXferRetryPolicyFactory can attribute circuit-breaker and telemetry accounting to the right host instead of
+// always assuming the primary), and the loser is left to finish in the background, where its response body (if
+// any) is drained and closed so its underlying TCP connection isn't leaked. This targets the long-tail latency
+// that a single slow try can otherwise impose when reading many small blocks from Blob storage. It is only safe
+// to use for idempotent GET/HEAD operations.
+func doWithHedge(ctx context.Context, next pipeline.Policy, request pipeline.Request, hedgeAfter time.Duration, secondaryHost string) (pipeline.Response, string, error) {
+	primaryHost := request.Request.URL.Host
+
+	// The winning leg's context is not cancelled here: its response body may still be unread, and cancelling it
+	// would abort that read. It is released when ctx is done.
+	primaryCtx, primaryCancel := context.WithCancel(ctx)
+	primaryResult := make(chan hedgedResult, 1)
+	go func() {
+		resp, err := next.Do(primaryCtx, request)
+		primaryResult <- hedgedResult{resp, err}
+	}()
+
+	select {
+	case r := <-primaryResult:
+		_ = primaryCancel
+		return r.response, primaryHost, r.err
+	case <-ctx.Done():
+		primaryCancel()
+		go drainLoser(primaryResult)
+		return nil, primaryHost, ctx.Err()
+	case <-time.After(hedgeAfter):
+		// The primary hasn't returned yet; fire the hedge and race the two legs.
+	}
+
+	hedgeCtx, hedgeCancel := context.WithCancel(ctx)
+	hedgeRequest := request.Copy()
+	if err := hedgeRequest.RewindBody(); err != nil {
+		panic(err)
+	}
+	hedgeHost := primaryHost
+	if secondaryHost != "" {
+		hedgeHost = secondaryHost
+		hedgeRequest.Request.URL.Host = secondaryHost
+	}
+	hedgeResult := make(chan hedgedResult, 1)
+	go func() {
+		resp, err := next.Do(hedgeCtx, hedgeRequest)
+		hedgeResult <- hedgedResult{resp, err}
+	}()
+
+	select {
+	case r := <-primaryResult:
+		hedgeCancel()
+		go drainLoser(hedgeResult)
+		_ = primaryCancel
+		return r.response, primaryHost, r.err
+	case r := <-hedgeResult:
+		primaryCancel()
+		go drainLoser(primaryResult)
+		_ = hedgeCancel
+		return r.response, hedgeHost, r.err
+	case <-ctx.Done():
+		primaryCancel()
+		hedgeCancel()
+		go drainLoser(primaryResult)
+		go drainLoser(hedgeResult)
+		return nil, primaryHost, ctx.Err()
+	}
+}
+
+// drainLoser waits for a hedged leg that lost the race to finish, then flushes and closes its response body (if
+// any) so we don't leak the underlying TCP connection.
+func drainLoser(result <-chan hedgedResult) {
+	r := <-result
+	if r.response != nil && r.response.Response() != nil {
+		io.Copy(ioutil.Discard, r.response.Response().Body)
+		r.response.Response().Body.Close()
+	}
+}
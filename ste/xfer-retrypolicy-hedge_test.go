@@ -0,0 +1,128 @@
+package ste
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+)
+
+// closeTrackingBody is an io.ReadCloser that records whether it has been closed, so a test can assert
+// the losing leg of a hedge race gets its response body drained and closed.
+type closeTrackingBody struct {
+	io.Reader
+	closed int32
+}
+
+func (b *closeTrackingBody) Close() error {
+	atomic.StoreInt32(&b.closed, 1)
+	return nil
+}
+
+// slowThenFastPolicy answers the primary host slowly and any other host immediately, so tests can
+// deterministically force the hedge leg to win.
+type slowThenFastPolicy struct {
+	slowHost string
+	slowFor  time.Duration
+	calls    int32
+}
+
+func (p *slowThenFastPolicy) Do(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+	atomic.AddInt32(&p.calls, 1)
+	if request.Request.URL.Host == p.slowHost {
+		select {
+		case <-time.After(p.slowFor):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	resp := &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: make(http.Header)}
+	return pipeline.NewHTTPResponse(resp), nil
+}
+
+func newHedgeTestRequest(host string) pipeline.Request {
+	u := url.URL{Scheme: "https", Host: host, Path: "/blob"}
+	req, err := pipeline.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		panic(err)
+	}
+	return req
+}
+
+func TestDoWithHedge_HedgeWinsWhenPrimaryIsSlow(t *testing.T) {
+	policy := &slowThenFastPolicy{slowHost: "primary.example.com", slowFor: time.Second}
+	request := newHedgeTestRequest("primary.example.com")
+
+	resp, host, err := doWithHedge(context.Background(), policy, request, 20*time.Millisecond, "secondary.example.com")
+	if err != nil {
+		t.Fatalf("doWithHedge returned err=%v", err)
+	}
+	if host != "secondary.example.com" {
+		t.Fatalf("got host=%q, want the hedge leg's host", host)
+	}
+	if resp == nil || resp.Response().StatusCode != http.StatusOK {
+		t.Fatalf("got resp=%v, want a 200 from the hedge leg", resp)
+	}
+
+	// The slow primary leg is still running in the background; give it time to finish and drain.
+	time.Sleep(1200 * time.Millisecond)
+	if calls := atomic.LoadInt32(&policy.calls); calls != 2 {
+		t.Fatalf("got %d calls to the inner policy, want 2 (primary + hedge)", calls)
+	}
+}
+
+func TestDoWithHedge_PrimaryWinsWithoutFiringHedge(t *testing.T) {
+	policy := &slowThenFastPolicy{slowHost: "unused.example.com", slowFor: time.Second}
+	request := newHedgeTestRequest("primary.example.com")
+
+	resp, host, err := doWithHedge(context.Background(), policy, request, 50*time.Millisecond, "secondary.example.com")
+	if err != nil {
+		t.Fatalf("doWithHedge returned err=%v", err)
+	}
+	if host != "primary.example.com" {
+		t.Fatalf("got host=%q, want the primary host", host)
+	}
+	if resp == nil {
+		t.Fatalf("got nil response")
+	}
+	if calls := atomic.LoadInt32(&policy.calls); calls != 1 {
+		t.Fatalf("got %d calls to the inner policy, want 1 (no hedge fired)", calls)
+	}
+}
+
+func TestDoWithHedge_DrainsLoserBody(t *testing.T) {
+	loserBody := &closeTrackingBody{Reader: strings.NewReader("stale primary body")}
+	policy := pipeline.PolicyFunc(func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+		if request.Request.URL.Host == "primary.example.com" {
+			// Ignores ctx cancellation deliberately: a real in-flight HTTP response can still arrive after
+			// we've stopped caring about it, which is exactly the case drainLoser exists to handle.
+			time.Sleep(200 * time.Millisecond)
+			return pipeline.NewHTTPResponse(&http.Response{StatusCode: http.StatusOK, Body: loserBody}), nil
+		}
+		return pipeline.NewHTTPResponse(&http.Response{StatusCode: http.StatusOK, Body: http.NoBody}), nil
+	})
+
+	req := newHedgeTestRequest("primary.example.com")
+	resp, host, err := doWithHedge(context.Background(), policy, req, 10*time.Millisecond, "secondary.example.com")
+	if err != nil {
+		t.Fatalf("doWithHedge returned err=%v", err)
+	}
+	if host != "secondary.example.com" {
+		t.Fatalf("got host=%q, want the hedge leg's host", host)
+	}
+	resp.Response().Body.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&loserBody.closed) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&loserBody.closed) == 0 {
+		t.Fatalf("losing leg's response body was never closed")
+	}
+}
@@ -0,0 +1,101 @@
+package ste
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// retryMetricsMaxDelaySamples bounds how many delays RetryMetrics keeps per host; older samples are overwritten
+// so a long-running recorder's memory stays flat instead of growing with the lifetime retry count.
+const retryMetricsMaxDelaySamples = 1024
+
+// retryMetricsKey identifies one (host, action) series in a RetryMetrics collector.
+type retryMetricsKey struct {
+	host   string
+	action string
+}
+
+// delayRing is a fixed-size ring buffer of the most recent retryMetricsMaxDelaySamples delays for one host.
+type delayRing struct {
+	buf   [retryMetricsMaxDelaySamples]time.Duration
+	next  int
+	count int
+}
+
+func (r *delayRing) add(d time.Duration) {
+	r.buf[r.next] = d
+	r.next = (r.next + 1) % len(r.buf)
+	if r.count < len(r.buf) {
+		r.count++
+	}
+}
+
+func (r *delayRing) values() []time.Duration {
+	out := make([]time.Duration, r.count)
+	start := (r.next - r.count + len(r.buf)) % len(r.buf)
+	for i := 0; i < r.count; i++ {
+		out[i] = r.buf[(start+i)%len(r.buf)]
+	}
+	return out
+}
+
+// RetryMetrics accumulates Prometheus-style counters and a per-host delay history from a retry policy's OnRetry
+// hook. It holds no dependency on an actual metrics client; callers wanting to export it to Prometheus (or
+// anywhere else) can read it back out through RetriesTotal and RetryDelaySeconds on whatever cadence they like.
+type RetryMetrics struct {
+	mu     sync.Mutex
+	total  map[retryMetricsKey]int64
+	delays map[string]*delayRing
+}
+
+// NewRetryMetrics creates an empty RetryMetrics collector.
+func NewRetryMetrics() *RetryMetrics {
+	return &RetryMetrics{total: make(map[retryMetricsKey]int64), delays: make(map[string]*delayRing)}
+}
+
+// Hook returns an XferRetryOptions.OnRetry callback that records each try into m. Assign it directly:
+// options.OnRetry = metrics.Hook()
+func (m *RetryMetrics) Hook() func(attempt int32, req *http.Request, resp *http.Response, err error, delay time.Duration, action string) {
+	return func(attempt int32, req *http.Request, resp *http.Response, err error, delay time.Duration, action string) {
+		host := ""
+		if req != nil {
+			host = req.URL.Host
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.total[retryMetricsKey{host: host, action: action}]++
+		ring := m.delays[host]
+		if ring == nil {
+			ring = &delayRing{}
+			m.delays[host] = ring
+		}
+		ring.add(delay)
+	}
+}
+
+// RetriesTotal returns how many times action was recorded against host (retries_total{host,action} in Prometheus
+// terms).
+func (m *RetryMetrics) RetriesTotal(host, action string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.total[retryMetricsKey{host: host, action: action}]
+}
+
+// RetryDelaySeconds returns, oldest first, up to the last retryMetricsMaxDelaySamples delays slept before a try
+// against host, in seconds (retry_delay_seconds in Prometheus terms). Callers needing quantiles can compute them
+// from this slice.
+func (m *RetryMetrics) RetryDelaySeconds(host string) []float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ring := m.delays[host]
+	if ring == nil {
+		return nil
+	}
+	delays := ring.values()
+	out := make([]float64, len(delays))
+	for i, d := range delays {
+		out[i] = d.Seconds()
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+package ste
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRetryMetrics_RetriesTotalPerHostAndAction(t *testing.T) {
+	m := NewRetryMetrics()
+	hook := m.Hook()
+
+	req := &http.Request{URL: &url.URL{Host: "account.blob.core.windows.net"}}
+	hook(1, req, nil, nil, 0, "Retry: classifier")
+	hook(2, req, nil, nil, 0, "Retry: classifier")
+	hook(3, req, nil, nil, 0, "NoRetry: classifier")
+
+	if got := m.RetriesTotal("account.blob.core.windows.net", "Retry: classifier"); got != 2 {
+		t.Fatalf("RetriesTotal(Retry: classifier) = %d, want 2", got)
+	}
+	if got := m.RetriesTotal("account.blob.core.windows.net", "NoRetry: classifier"); got != 1 {
+		t.Fatalf("RetriesTotal(NoRetry: classifier) = %d, want 1", got)
+	}
+	if got := m.RetriesTotal("account.blob.core.windows.net", "Retry: Secondary URL returned 404"); got != 0 {
+		t.Fatalf("RetriesTotal(unrecorded action) = %d, want 0", got)
+	}
+	if got := m.RetriesTotal("other-host", "Retry: classifier"); got != 0 {
+		t.Fatalf("RetriesTotal(other host) = %d, want 0", got)
+	}
+}
+
+func TestRetryMetrics_RetryDelaySecondsCapsAndKeepsOldestFirst(t *testing.T) {
+	m := NewRetryMetrics()
+	hook := m.Hook()
+	req := &http.Request{URL: &url.URL{Host: "account.blob.core.windows.net"}}
+
+	const pushed = retryMetricsMaxDelaySamples + 10
+	for i := 0; i < pushed; i++ {
+		hook(int32(i+1), req, nil, nil, time.Duration(i+1)*time.Millisecond, "Retry: classifier")
+	}
+
+	got := m.RetryDelaySeconds("account.blob.core.windows.net")
+	if len(got) != retryMetricsMaxDelaySamples {
+		t.Fatalf("len(RetryDelaySeconds) = %d, want %d", len(got), retryMetricsMaxDelaySamples)
+	}
+
+	// The first `pushed - retryMetricsMaxDelaySamples` delays (1ms..10ms) should have been overwritten; the
+	// oldest surviving sample is the 11th push (11ms), and samples should come back oldest-first.
+	wantFirst := 11 * time.Millisecond
+	if got[0] != wantFirst.Seconds() {
+		t.Fatalf("RetryDelaySeconds()[0] = %v, want %v", got[0], wantFirst.Seconds())
+	}
+	wantLast := time.Duration(pushed) * time.Millisecond
+	if got[len(got)-1] != wantLast.Seconds() {
+		t.Fatalf("RetryDelaySeconds()[last] = %v, want %v", got[len(got)-1], wantLast.Seconds())
+	}
+}
+
+func TestRetryMetrics_RetryDelaySecondsUnknownHost(t *testing.T) {
+	m := NewRetryMetrics()
+	if got := m.RetryDelaySeconds("never-seen-host"); got != nil {
+		t.Fatalf("RetryDelaySeconds(unknown host) = %v, want nil", got)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
-	"net"
 	"net/http"
 	"strconv"
 	"time"
@@ -57,6 +56,59 @@ type XferRetryOptions struct {
 	// NOTE: Before setting this field, make sure you understand the issues around reading stale & potentially-inconsistent
 	// data at this webpage: https://docs.microsoft.com/en-us/azure/storage/common/storage-designing-ha-apps-with-ragrs
 	RetryReadsFromSecondaryHost string // Comment this our for non-Blob SDKs
+
+	// MaxRetryDelayFactor bounds how far a server-provided Retry-After header (see parseRetryAfter) may push the delay
+	// before the next try out past MaxRetryDelay. The effective cap is MaxRetryDelay*MaxRetryDelayFactor
+	// (0=default of 4), so a server hinting at an unreasonably long wait cannot stall an operation indefinitely.
+	MaxRetryDelayFactor float64
+
+	// HedgeAfter, if non-zero, enables backup-request ("hedged read") behavior for idempotent GET/HEAD operations:
+	// if the try against the primary has not completed within HedgeAfter, a second concurrent request is fired
+	// (against RetryReadsFromSecondaryHost if set, else the primary host again) and whichever leg completes first
+	// wins; the other is cancelled and its response body drained and closed. This guards against the long tail of
+	// latency when reading many small blocks, at the cost of potentially doubling load for slow-but-not-failing
+	// requests, so it defaults to off (0=disabled).
+	HedgeAfter time.Duration
+
+	// Classifier, if non-nil, overrides the policy's built-in logic (see defaultRetryClassifier) for deciding
+	// whether a completed try should be retried.
+	Classifier RetryClassifier
+
+	// CircuitBreakerThreshold, CircuitBreakerWindow and CircuitBreakerCooldown configure an optional per-host
+	// circuit breaker that runs in front of Classifier (or the built-in classifier, if Classifier is nil): once
+	// the fraction of failed tries against a host exceeds CircuitBreakerThreshold within CircuitBreakerWindow,
+	// further tries against that host are refused with a *CircuitOpenError for CircuitBreakerCooldown before being
+	// attempted again. CircuitBreakerThreshold of 0 disables the breaker (0=default), since stopping all work
+	// against a host is a meaningful behavior change a caller should opt into explicitly.
+	CircuitBreakerThreshold float64
+	CircuitBreakerWindow    time.Duration
+	CircuitBreakerCooldown  time.Duration
+
+	// OnRetry, if non-nil, is invoked once per try (including the final, non-retried try) with the request that was
+	// sent, the response it got back (nil on a transport error), the error (nil on a successful response), the
+	// delay that was slept before this try, and the chosen action string ("Retry: ..." or "NoRetry: ..."). See
+	// RetryMetrics for a ready-made recorder. A try refused by the circuit breaker or by MaxElapsedTime is reported
+	// too, with the original request (nothing was sent), a nil response and the refusal error; for a MaxElapsedTime
+	// refusal, delay is the delay that would have been slept.
+	OnRetry func(attempt int32, req *http.Request, resp *http.Response, err error, delay time.Duration, action string)
+
+	// MaxElapsedTime bounds the aggregate wall-clock time spent across all tries of an operation (0=disabled, the
+	// default). Without it, a multi-GB file can sleep up to MaxRetryDelay between each of MaxTries attempts with
+	// no cap on the total; once time.Since(the first try)+the next try's delay would exceed MaxElapsedTime, the
+	// policy gives up with a *RetryBudgetExceededError instead of sleeping. The remaining budget also clamps each
+	// try's own timeout, so a single try can't itself consume the whole remaining budget.
+	MaxElapsedTime time.Duration
+}
+
+// RetryBudgetExceededError is returned (as the operation's err) when o.MaxElapsedTime would be exceeded by
+// sleeping before another try, even though MaxTries has not yet been reached.
+type RetryBudgetExceededError struct {
+	Elapsed time.Duration
+	Budget  time.Duration
+}
+
+func (e *RetryBudgetExceededError) Error() string {
+	return "retry budget of " + e.Budget.String() + " exceeded after " + e.Elapsed.String()
 }
 
 func (o XferRetryOptions) retryReadsFromSecondaryHost() string {
@@ -91,6 +143,13 @@ func (o XferRetryOptions) defaults() XferRetryOptions {
 	if o.MaxTries == 0 {
 		o.MaxTries = 4
 	}
+	if o.MaxRetryDelayFactor == 0 {
+		o.MaxRetryDelayFactor = 4
+	}
+	if o.CircuitBreakerThreshold > 0 {
+		IfDefault(&o.CircuitBreakerWindow, 30*time.Second)
+		IfDefault(&o.CircuitBreakerCooldown, 60*time.Second)
+	}
 	switch o.Policy {
 	case RetryPolicyExponential:
 		IfDefault(&o.TryTimeout, 1*time.Minute)
@@ -133,17 +192,177 @@ func (o XferRetryOptions) calcDelay(try int32) time.Duration { // try is >=1; ne
 	return delay
 }
 
+// retryOptionsContextKeyType is unexported to prevent collisions with context keys defined in other packages.
+type retryOptionsContextKeyType struct{}
+
+// retryOptionsContextKey is the context.Context key under which a per-request XferRetryOptions override is stored.
+var retryOptionsContextKey = retryOptionsContextKeyType{}
+
+// WithRetryOptions returns a copy of ctx carrying o as a per-request override of the XferRetryOptions that the
+// pipeline was constructed with. A policy created by NewXferRetryPolicyFactory merges o onto its own options (see
+// mergeRetryOptions) for any request made with the returned Context, so a caller only needs to set the fields it
+// actually wants to change (for example a short MaxTries/TryTimeout for a cheap control-plane call, or a long
+// RetryDelay for a multi-GB block upload) without standing up a whole new pipeline, and without losing the rest of
+// the pipeline's configuration (Classifier, OnRetry, circuit breaker, ...) for that request.
+func WithRetryOptions(ctx context.Context, o XferRetryOptions) context.Context {
+	return context.WithValue(ctx, retryOptionsContextKey, o)
+}
+
+// retryOptionsFromContext returns the XferRetryOptions attached to ctx by WithRetryOptions, if any.
+func retryOptionsFromContext(ctx context.Context) (XferRetryOptions, bool) {
+	o, ok := ctx.Value(retryOptionsContextKey).(XferRetryOptions)
+	return o, ok
+}
+
+// mergeRetryOptions returns a copy of base with every field that override left at its zero value still coming
+// from base, and every field override set replacing base's. This is what lets WithRetryOptions be a true subset
+// override (e.g. just MaxTries) instead of a wholesale replacement that would otherwise silently drop base's
+// Classifier, OnRetry hook, circuit breaker and hedging configuration for that one request.
+func mergeRetryOptions(base, override XferRetryOptions) XferRetryOptions {
+	merged := base
+	if override.Policy != 0 {
+		merged.Policy = override.Policy
+	}
+	if override.MaxTries != 0 {
+		merged.MaxTries = override.MaxTries
+	}
+	if override.TryTimeout != 0 {
+		merged.TryTimeout = override.TryTimeout
+	}
+	if override.RetryDelay != 0 {
+		merged.RetryDelay = override.RetryDelay
+	}
+	if override.MaxRetryDelay != 0 {
+		merged.MaxRetryDelay = override.MaxRetryDelay
+	}
+	if override.RetryReadsFromSecondaryHost != "" {
+		merged.RetryReadsFromSecondaryHost = override.RetryReadsFromSecondaryHost
+	}
+	if override.MaxRetryDelayFactor != 0 {
+		merged.MaxRetryDelayFactor = override.MaxRetryDelayFactor
+	}
+	if override.HedgeAfter != 0 {
+		merged.HedgeAfter = override.HedgeAfter
+	}
+	if override.Classifier != nil {
+		merged.Classifier = override.Classifier
+	}
+	if override.CircuitBreakerThreshold != 0 {
+		merged.CircuitBreakerThreshold = override.CircuitBreakerThreshold
+	}
+	if override.CircuitBreakerWindow != 0 {
+		merged.CircuitBreakerWindow = override.CircuitBreakerWindow
+	}
+	if override.CircuitBreakerCooldown != 0 {
+		merged.CircuitBreakerCooldown = override.CircuitBreakerCooldown
+	}
+	if override.OnRetry != nil {
+		merged.OnRetry = override.OnRetry
+	}
+	if override.MaxElapsedTime != 0 {
+		merged.MaxElapsedTime = override.MaxElapsedTime
+	}
+	return merged
+}
+
+// parseRetryAfter extracts a server-suggested retry delay from resp's Retry-After header, if present. Per RFC 7231
+// section 7.1.3, the header's value is either an integer number of seconds or an HTTP-date.
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	h := resp.Header.Get("Retry-After")
+	if h == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(h); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true // The date has already passed; retry immediately.
+	}
+	return 0, false
+}
+
+// resolveClassifier returns o.Classifier, or a defaultRetryClassifier if o.Classifier is nil.
+func resolveClassifier(o XferRetryOptions) RetryClassifier {
+	if o.Classifier != nil {
+		return o.Classifier
+	}
+	return defaultRetryClassifier{}
+}
+
+// resolveCircuitBreaker returns a *circuitBreaker configured from o's CircuitBreaker* fields, or nil if
+// o.CircuitBreakerThreshold is 0 (the breaker is disabled).
+func resolveCircuitBreaker(o XferRetryOptions) *circuitBreaker {
+	if o.CircuitBreakerThreshold <= 0 {
+		return nil
+	}
+	return newCircuitBreaker(o.CircuitBreakerThreshold, o.CircuitBreakerWindow, o.CircuitBreakerCooldown)
+}
+
+// requestForHost returns req as-is if req.URL.Host already equals host, otherwise a shallow copy of req with
+// URL.Host set to host. This lets callers (notably OnRetry telemetry) report the host a try actually went to —
+// which, for a hedged try, can be the hedge host even though the try's own *http.Request was built against the
+// primary — without mutating the original request.
+func requestForHost(req *http.Request, host string) *http.Request {
+	if req.URL.Host == host {
+		return req
+	}
+	reqCopy := *req
+	urlCopy := *req.URL
+	urlCopy.Host = host
+	reqCopy.URL = &urlCopy
+	return &reqCopy
+}
+
 // NewXferRetryPolicyFactory creates a RetryPolicyFactory object configured using the specified options.
 func NewXferRetryPolicyFactory(o XferRetryOptions) pipeline.Factory {
 	o = o.defaults() // Force defaults to be calculated
+	classifier := resolveClassifier(o)
+	breaker := resolveCircuitBreaker(o)
 	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
 		return func(ctx context.Context, request pipeline.Request) (response pipeline.Response, err error) {
+			// A request can override our options by attaching its own XferRetryOptions to ctx.
+			o := o
+			classifier := classifier
+			breaker := breaker
+			if ctxOptions, ok := retryOptionsFromContext(ctx); ok {
+				o = mergeRetryOptions(o, ctxOptions).defaults()
+				// Only rebuild the classifier/breaker when the override actually touches the fields they're
+				// derived from; otherwise keep sharing the factory-level ones so a context override of an
+				// unrelated field (e.g. MaxTries) doesn't hand the call a brand-new circuit breaker with no
+				// memory of that host's accumulated failures.
+				if ctxOptions.Classifier != nil {
+					classifier = resolveClassifier(o)
+				}
+				if ctxOptions.CircuitBreakerThreshold != 0 ||
+					ctxOptions.CircuitBreakerWindow != 0 ||
+					ctxOptions.CircuitBreakerCooldown != 0 {
+					breaker = resolveCircuitBreaker(o)
+				}
+			}
+
 			// Before each try, we'll select either the primary or secondary URL.
 			primaryTry := int32(0) // This indicates how many tries we've attempted against the primary DC
 
 			// We only consider retrying against a secondary if we have a read request (GET/HEAD) AND this policy has a Secondary URL it can use
 			considerSecondary := (request.Method == http.MethodGet || request.Method == http.MethodHead) && o.retryReadsFromSecondaryHost() != ""
 
+			// retryAfter carries a server-suggested delay (from a prior try's Retry-After header) into the delay
+			// computation for the next try against the primary.
+			retryAfter := time.Duration(0)
+			maxRetryAfter := time.Duration(float64(o.MaxRetryDelay) * o.MaxRetryDelayFactor)
+
+			// start anchors o.MaxElapsedTime: the retry budget is measured from the first try, not per-try.
+			start := time.Now()
+
 			// Exponential retry algorithm: ((2 ^ attempt) - 1) * delay * random(0.8, 1.2)
 			// When to retry: connection failure or temporary/timeout. NOTE: StorageError considers HTTP 500/503 as temporary & is therefore retryable
 			// If using a secondary:
@@ -156,18 +375,53 @@ func NewXferRetryPolicyFactory(o XferRetryOptions) pipeline.Factory {
 
 				// Determine which endpoint to try. It's primary if there is no secondary or if it is an add # attempt.
 				tryingPrimary := !considerSecondary || (try%2 == 1)
+
+				host := request.Request.URL.Host
+				if !tryingPrimary {
+					host = o.retryReadsFromSecondaryHost()
+				}
+				if breaker != nil {
+					if cbErr := breaker.allow(host); cbErr != nil {
+						err, response = cbErr, nil
+						logf("Action=NoRetry: %v\n", cbErr)
+						if o.OnRetry != nil {
+							o.OnRetry(try, request.Request, nil, cbErr, 0, "NoRetry: circuit open")
+						}
+						break // The circuit is open for this host; don't even dial it.
+					}
+				}
+
 				// Select the correct host and delay
+				var delay time.Duration
 				if tryingPrimary {
 					primaryTry++
-					delay := o.calcDelay(primaryTry)
+					delay = o.calcDelay(primaryTry)
+					if retryAfter > delay {
+						delay = retryAfter // Honor the server's Retry-After hint from the previous try, if larger
+					}
+					if delay > maxRetryAfter {
+						delay = maxRetryAfter
+					}
+					retryAfter = 0
 					logf("Primary try=%d, Delay=%v\n", primaryTry, delay)
-					time.Sleep(delay) // The 1st try returns 0 delay
 				} else {
-					delay := time.Second * time.Duration(rand.Float32()/2+0.8)
+					delay = time.Second * time.Duration(rand.Float32()/2+0.8)
 					logf("Secondary try=%d, Delay=%v\n", try-primaryTry, delay)
-					time.Sleep(delay) // Delay with some jitter before trying secondary
 				}
 
+				if o.MaxElapsedTime > 0 {
+					if elapsed := time.Since(start); elapsed+delay > o.MaxElapsedTime {
+						err = &RetryBudgetExceededError{Elapsed: elapsed, Budget: o.MaxElapsedTime}
+						response = nil
+						logf("Action=NoRetry: %v\n", err)
+						if o.OnRetry != nil {
+							o.OnRetry(try, request.Request, nil, err, delay, "NoRetry: retry budget exceeded")
+						}
+						break // Sleeping for delay would blow the aggregate retry budget; give up now instead.
+					}
+				}
+				time.Sleep(delay) // The 1st primary try returns 0 delay
+
 				// Clone the original request to ensure that each try starts with the original (unmutated) request.
 				requestCopy := request.Copy()
 
@@ -200,15 +454,41 @@ func NewXferRetryPolicyFactory(o XferRetryOptions) pipeline.Factory {
 				logf("Url=%s\n", requestCopy.Request.URL.String())
 
 				// Set the time for this particular retry operation and then Do the operation.
-				tryCtx, tryCancel := context.WithTimeout(ctx, time.Second*time.Duration(timeout))
+				tryTimeout := time.Second * time.Duration(timeout)
+				if o.MaxElapsedTime > 0 {
+					if remaining := o.MaxElapsedTime - time.Since(start); remaining < tryTimeout {
+						tryTimeout = remaining
+					}
+				}
+				tryCtx, tryCancel := context.WithTimeout(ctx, tryTimeout)
 				//requestCopy.Body = &deadlineExceededReadCloser{r: requestCopy.Request.Body}
-				response, err = next.Do(tryCtx, requestCopy) // Make the request
+				if tryingPrimary && o.HedgeAfter > 0 && (request.Method == http.MethodGet || request.Method == http.MethodHead) {
+					// Hedging only ever races against the primary try; a hedge of a hedge (or of a secondary-host
+					// try) would just double the load we're already trying to shed from a slow endpoint. Once
+					// considerSecondary has been cleared (e.g. a secondary 404 told us to stop using it for this
+					// operation), the hedge must stop racing that excluded host too, so only pass it through here
+					// while it's still in play; doWithHedge falls back to hedging against the primary itself.
+					hedgeSecondaryHost := ""
+					if considerSecondary {
+						hedgeSecondaryHost = o.retryReadsFromSecondaryHost()
+					}
+					response, host, err = doWithHedge(tryCtx, next, requestCopy, o.HedgeAfter, hedgeSecondaryHost)
+				} else {
+					response, err = next.Do(tryCtx, requestCopy) // Make the request
+				}
 				/*err = improveDeadlineExceeded(err)
 				if err == nil {
 					response.Response().Body = &deadlineExceededReadCloser{r: response.Response().Body}
 				}*/
 				logf("Err=%v, response=%v\n", err, response)
 
+				if response != nil {
+					retryAfter, _ = parseRetryAfter(response.Response())
+				}
+				if breaker != nil {
+					breaker.record(host, err != nil || (response != nil && response.Response().StatusCode >= http.StatusInternalServerError))
+				}
+
 				action := "" // This MUST get changed within the switch code below
 				switch {
 				case ctx.Err() != nil:
@@ -219,26 +499,32 @@ func NewXferRetryPolicyFactory(o XferRetryOptions) pipeline.Factory {
 					// case, we'll never try the secondary again for this operation.
 					considerSecondary = false
 					action = "Retry: Secondary URL returned 404"
-				case response != nil && response.Response().StatusCode == http.StatusBadRequest:
-					// If the request failed with Bad Request, then there is no need to retry since
-					// the request will fail on the future retries as well.
-					action = "NoRetry: bad request error"
-				case err != nil:
-					// NOTE: Protocol Responder returns non-nil if REST API returns invalid status code for the invoked operation
-					// retry on all the network errors.
-					// zc_policy_retry perform the retries on Temporary and Timeout Errors only.
-					// some errors like 'connection reset by peer' or 'transport connection broken' does not implement the Temporary interface
-					// but they should be retried. So redefined the retry policy for azcopy to retry for such errors as well.
-					if _, ok := err.(net.Error); ok {
-						action = "Retry: net.Error and Temporary() or Timeout()"
-					} else {
-						action = "NoRetry: unrecognized error"
-					}
 				default:
-					action = "NoRetry: successful HTTP request" // no error
+					// Everything else is decided by the pluggable classifier (see RetryClassifier), which
+					// reproduces the original hard-coded rules by default.
+					switch classifier.Classify(response, err, try) {
+					case RetryActionRetry:
+						action = "Retry: classifier"
+					case RetryActionRetryOnSecondary:
+						if o.retryReadsFromSecondaryHost() != "" {
+							considerSecondary = true
+						}
+						action = "Retry: classifier (secondary)"
+					case RetryActionFatal:
+						action = "NoRetry: classifier (fatal)"
+					default:
+						action = "NoRetry: classifier"
+					}
 				}
 
 				logf("Action=%s\n", action)
+				if o.OnRetry != nil {
+					var httpResp *http.Response
+					if response != nil {
+						httpResp = response.Response()
+					}
+					o.OnRetry(try, requestForHost(requestCopy.Request, host), httpResp, err, delay, action)
+				}
 				// fmt.Println(action + "\n") // This is where we could log the retry operation; action is why we're retrying
 				if action[0] != 'R' { // Retry only if action starts with 'R'
 					if err != nil {
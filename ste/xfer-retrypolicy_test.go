@@ -0,0 +1,201 @@
+package ste
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+)
+
+func TestParseRetryAfter_Seconds(t *testing.T) {
+	header := make(http.Header)
+	header.Set("Retry-After", "5")
+	resp := &http.Response{Header: header}
+
+	d, ok := parseRetryAfter(resp)
+	if !ok {
+		t.Fatalf("got ok=false, want true")
+	}
+	if d != 5*time.Second {
+		t.Fatalf("got delay=%v, want 5s", d)
+	}
+}
+
+func TestParseRetryAfter_HTTPDate(t *testing.T) {
+	header := make(http.Header)
+	header.Set("Retry-After", time.Now().Add(10*time.Second).UTC().Format(http.TimeFormat))
+	resp := &http.Response{Header: header}
+
+	d, ok := parseRetryAfter(resp)
+	if !ok {
+		t.Fatalf("got ok=false, want true")
+	}
+	if d <= 0 || d > 10*time.Second {
+		t.Fatalf("got delay=%v, want roughly 10s", d)
+	}
+}
+
+func TestParseRetryAfter_MissingOrInvalid(t *testing.T) {
+	if _, ok := parseRetryAfter(&http.Response{Header: make(http.Header)}); ok {
+		t.Fatalf("got ok=true for a missing header, want false")
+	}
+
+	header := make(http.Header)
+	header.Set("Retry-After", "not-a-valid-value")
+	if _, ok := parseRetryAfter(&http.Response{Header: header}); ok {
+		t.Fatalf("got ok=true for an invalid header, want false")
+	}
+}
+
+func TestMergeRetryOptions_PreservesUnsetFieldsFromBase(t *testing.T) {
+	var onRetryCalls int
+	base := XferRetryOptions{
+		MaxTries:                3,
+		Classifier:              &customClassifier{action: RetryActionRetry},
+		CircuitBreakerThreshold: 0.5,
+		HedgeAfter:              2 * time.Second,
+		MaxElapsedTime:          time.Minute,
+		OnRetry: func(attempt int32, req *http.Request, resp *http.Response, err error, delay time.Duration, action string) {
+			onRetryCalls++
+		},
+	}
+
+	override := XferRetryOptions{MaxTries: 7}
+	merged := mergeRetryOptions(base, override)
+
+	if merged.MaxTries != 7 {
+		t.Fatalf("got MaxTries=%d, want the override's 7", merged.MaxTries)
+	}
+	if merged.Classifier != base.Classifier {
+		t.Fatalf("merge dropped base.Classifier")
+	}
+	if merged.CircuitBreakerThreshold != base.CircuitBreakerThreshold {
+		t.Fatalf("merge dropped base.CircuitBreakerThreshold")
+	}
+	if merged.HedgeAfter != base.HedgeAfter {
+		t.Fatalf("merge dropped base.HedgeAfter")
+	}
+	if merged.MaxElapsedTime != base.MaxElapsedTime {
+		t.Fatalf("merge dropped base.MaxElapsedTime")
+	}
+	if merged.OnRetry == nil {
+		t.Fatalf("merge dropped base.OnRetry")
+	}
+	merged.OnRetry(1, nil, nil, nil, 0, "")
+	if onRetryCalls != 1 {
+		t.Fatalf("merged.OnRetry did not invoke base's hook")
+	}
+}
+
+// countingPolicy always fails, so the retry loop keeps trying until something stops it.
+type countingPolicy struct {
+	calls int32
+}
+
+func (p *countingPolicy) Do(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+	p.calls++
+	header := make(http.Header)
+	header.Set("Retry-After", "1") // keeps the classifier retrying instead of giving up after one try
+	return pipeline.NewHTTPResponse(&http.Response{StatusCode: http.StatusServiceUnavailable, Header: header, Body: http.NoBody}), nil
+}
+
+// failingOncePolicy always returns a 500, so each call to it (with MaxTries: 1) records exactly one failure
+// against the circuit breaker.
+type failingOncePolicy struct {
+	calls int32
+}
+
+func (p *failingOncePolicy) Do(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+	p.calls++
+	return pipeline.NewHTTPResponse(&http.Response{StatusCode: http.StatusInternalServerError, Body: http.NoBody}), nil
+}
+
+func TestNewXferRetryPolicyFactory_ContextOverrideOfUnrelatedFieldPreservesCircuitBreakerState(t *testing.T) {
+	inner := &failingOncePolicy{}
+	factory := NewXferRetryPolicyFactory(XferRetryOptions{
+		Policy:                  RetryPolicyFixed,
+		MaxTries:                1,
+		RetryDelay:              time.Millisecond,
+		MaxRetryDelay:           time.Millisecond,
+		CircuitBreakerThreshold: 0.5,
+		CircuitBreakerWindow:    time.Minute,
+		CircuitBreakerCooldown:  time.Hour,
+	})
+	policy := factory.New(inner, &pipeline.PolicyOptions{})
+
+	u := url.URL{Scheme: "https", Host: "example.com", Path: "/blob"}
+
+	// Drive minCircuitBreakerSamples failures through the factory-level breaker using plain, non-overridden
+	// contexts, which should trip it for example.com. A 500 with MaxTries: 1 isn't retried by the default
+	// classifier, so it comes back as a response (StatusInternalServerError), not an err.
+	for i := 0; i < minCircuitBreakerSamples; i++ {
+		request, err := pipeline.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		resp, err := policy.Do(context.Background(), request)
+		if err != nil {
+			t.Fatalf("call %d: got err=%v, want nil (the breaker shouldn't have tripped yet)", i, err)
+		}
+		if resp.Response().StatusCode != http.StatusInternalServerError {
+			t.Fatalf("call %d: got status %d, want %d", i, resp.Response().StatusCode, http.StatusInternalServerError)
+		}
+	}
+
+	// A later call that overrides an unrelated field (MaxTries) via WithRetryOptions must still see the
+	// tripped breaker instead of getting a fresh one with no memory of example.com's failures (chunk0-4's
+	// 79d31af fixed a regression where it didn't).
+	callsBeforeOverride := inner.calls
+	request, err := pipeline.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	ctx := WithRetryOptions(context.Background(), XferRetryOptions{MaxTries: 2})
+	_, err = policy.Do(ctx, request)
+
+	if err == nil {
+		t.Fatalf("got nil err, want *CircuitOpenError")
+	}
+	cbErr, ok := err.(*CircuitOpenError)
+	if !ok {
+		t.Fatalf("got err of type %T, want *CircuitOpenError", err)
+	}
+	if cbErr.Host != "example.com" {
+		t.Fatalf("got Host=%q, want %q", cbErr.Host, "example.com")
+	}
+	if inner.calls != callsBeforeOverride {
+		t.Fatalf("got %d calls to inner policy, want %d (the breaker should have refused the try before dialing)", inner.calls, callsBeforeOverride)
+	}
+}
+
+func TestNewXferRetryPolicyFactory_MaxElapsedTimeAbortsBeforeMaxTries(t *testing.T) {
+	inner := &countingPolicy{}
+	factory := NewXferRetryPolicyFactory(XferRetryOptions{
+		Policy:         RetryPolicyFixed,
+		MaxTries:       20,
+		RetryDelay:     200 * time.Millisecond,
+		MaxRetryDelay:  200 * time.Millisecond,
+		MaxElapsedTime: 300 * time.Millisecond,
+	})
+	policy := factory.New(inner, &pipeline.PolicyOptions{})
+
+	u := url.URL{Scheme: "https", Host: "example.com", Path: "/blob"}
+	request, err := pipeline.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+
+	_, err = policy.Do(context.Background(), request)
+	if err == nil {
+		t.Fatalf("got nil err, want *RetryBudgetExceededError")
+	}
+	if _, ok := err.(*RetryBudgetExceededError); !ok {
+		t.Fatalf("got err of type %T, want *RetryBudgetExceededError", err)
+	}
+	if inner.calls >= 20 {
+		t.Fatalf("got %d tries, want fewer than MaxTries (budget should have cut it off first)", inner.calls)
+	}
+}